@@ -0,0 +1,140 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netfilter
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+const matcherNameBPF = "bpf"
+
+func init() {
+	registerMatchMaker(bpfMarshaler{})
+}
+
+// bpfMarshaler implements matchMaker for the xt_bpf classic BPF matcher.
+type bpfMarshaler struct{}
+
+// name implements matchMaker.name.
+func (bpfMarshaler) name() string {
+	return matcherNameBPF
+}
+
+// marshal implements matchMaker.marshal.
+func (bpfMarshaler) marshal(mr stack.Matcher) []byte {
+	matcher := mr.(*BPFMatcher)
+	xtbpf := linux.XTBPFInfo{
+		Mode:       linux.XTBPFModeBytecode,
+		BPFProgram: matcher.program,
+	}
+	buf := make([]byte, 0, linux.SizeOfXTBPFInfo(len(matcher.program)))
+	return marshalEntryMatch(matcherNameBPF, binary.Marshal(buf, usermem.ByteOrder, xtbpf))
+}
+
+// unmarshal implements matchMaker.unmarshal.
+func (bpfMarshaler) unmarshal(buf []byte, filter stack.IPHeaderFilter) (stack.Matcher, error) {
+	if len(buf) < linux.SizeOfXTBPFInfoHeader {
+		return nil, fmt.Errorf("buf has insufficient size for BPF match: %d", len(buf))
+	}
+
+	var info linux.XTBPFInfo
+	if err := binary.Unmarshal(buf, usermem.ByteOrder, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal XTBPFInfo: %v", err)
+	}
+	nflog("parseMatchers: parsed XTBPFInfo: mode=%d, %d instructions", info.Mode, len(info.BPFProgram))
+
+	if info.Mode != linux.XTBPFModeBytecode {
+		return nil, fmt.Errorf("bpf matcher mode %d is not supported; only inline bytecode (mode 0) is implemented", info.Mode)
+	}
+
+	vm, err := bpf.NewVM(rawBPFInstructions(info.BPFProgram))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cBPF program: %v", err)
+	}
+
+	return &BPFMatcher{
+		program: info.BPFProgram,
+		vm:      vm,
+	}, nil
+}
+
+// rawBPFInstructions converts the wire-format sock_filter array into
+// golang.org/x/net/bpf instructions, disassembling each raw instruction into
+// the decoded form the VM validates and executes.
+func rawBPFInstructions(prog []linux.SockFilter) []bpf.Instruction {
+	insns := make([]bpf.Instruction, 0, len(prog))
+	for _, sf := range prog {
+		insns = append(insns, bpf.RawInstruction{
+			Op: sf.Code,
+			Jt: sf.JT,
+			Jf: sf.JF,
+			K:  sf.K,
+		}.Disassemble())
+	}
+	return insns
+}
+
+// BPFMatcher matches packets against a classic BPF program, mirroring
+// Linux's xt_bpf. It implements Matcher.
+type BPFMatcher struct {
+	// program is kept around purely so marshal can round-trip the original
+	// bytecode back out on iptables-save/iptables -L.
+	program []linux.SockFilter
+	vm      *bpf.VM
+}
+
+// Name implements Matcher.Name.
+func (*BPFMatcher) Name() string {
+	return matcherNameBPF
+}
+
+// Match implements Matcher.Match.
+func (bm *BPFMatcher) Match(hook stack.Hook, pkt stack.PacketBuffer, interfaceName string) (bool, bool) {
+	if pkt.Parsed == nil || pkt.Parsed.NetworkHeader == nil {
+		if pkt.Parsed != nil && pkt.Parsed.Malformed {
+			// Matching TCPMatcher: there's no valid IP header here, so we
+			// hotdrop the packet.
+			return false, true
+		}
+		// The network header simply hasn't been parsed for this hook; not
+		// a match.
+		return false, false
+	}
+
+	// Reconstruct a linear view of the packet as cBPF would see it: network
+	// header, transport header (if stack.Check could parse one), and
+	// payload.
+	buf := append([]byte{}, pkt.Parsed.NetworkHeader...)
+	if pkt.Parsed.TransportAvailable {
+		buf = append(buf, pkt.Parsed.TransportHeader...)
+	}
+	buf = append(buf, pkt.Data.ToView()...)
+
+	ret, err := bm.vm.Run(buf)
+	if err != nil {
+		// A malformed packet relative to the program (e.g. a load past the
+		// end of the buffer) is not a match, matching Linux's behavior of
+		// treating short packets as a non-match rather than hotdropping.
+		return false, false
+	}
+
+	return ret != 0, false
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netfilter
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+// assembleSockFilter compiles insns and converts them to the wire-format
+// linux.SockFilter array xt_bpf carries, the same form bpfMarshaler.marshal
+// produces and bpfMarshaler.unmarshal consumes.
+func assembleSockFilter(t *testing.T, insns []bpf.Instruction) []linux.SockFilter {
+	t.Helper()
+	raw, err := bpf.Assemble(insns)
+	if err != nil {
+		t.Fatalf("bpf.Assemble() failed: %v", err)
+	}
+	prog := make([]linux.SockFilter, 0, len(raw))
+	for _, r := range raw {
+		prog = append(prog, linux.SockFilter{Code: r.Op, JT: r.Jt, JF: r.Jf, K: r.K})
+	}
+	return prog
+}
+
+// tcpDestPort80Program returns a cBPF program equivalent to xt_tcp's
+// `--dport 80`: it loads the 16-bit destination port out of the TCP header
+// that immediately follows a 20-byte (no-options) IPv4 header and compares
+// it against 80.
+func tcpDestPort80Program(t *testing.T) []linux.SockFilter {
+	t.Helper()
+	return assembleSockFilter(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Off: header.IPv4MinimumSize + 2, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+}
+
+func buildIPv4Header(protocol uint8) []byte {
+	hdr := make([]byte, header.IPv4MinimumSize)
+	hdr[0] = 0x45 // version 4, 20-byte (no options) header
+	hdr[9] = protocol
+	return hdr
+}
+
+// marshalXTBPFInfo encodes info the same way bpfMarshaler.marshal does,
+// without the marshalEntryMatch wrapping unmarshal doesn't expect.
+func marshalXTBPFInfo(info linux.XTBPFInfo) []byte {
+	buf := make([]byte, 0, linux.SizeOfXTBPFInfo(len(info.BPFProgram)))
+	return binary.Marshal(buf, usermem.ByteOrder, info)
+}
+
+func newBPFMatcher(t *testing.T, prog []linux.SockFilter) *BPFMatcher {
+	t.Helper()
+	buf := marshalXTBPFInfo(linux.XTBPFInfo{Mode: linux.XTBPFModeBytecode, BPFProgram: prog})
+	m, err := (bpfMarshaler{}).unmarshal(buf, stack.IPHeaderFilter{Protocol: header.TCPProtocolNumber})
+	if err != nil {
+		t.Fatalf("unmarshal() failed: %v", err)
+	}
+	return m.(*BPFMatcher)
+}
+
+func bpfPacketWithTCPDestPort(destPort uint16) stack.PacketBuffer {
+	ip := buildIPv4Header(uint8(header.TCPProtocolNumber))
+	tcp := buildTCPSegment(1234, destPort, 0, nil)
+	return stack.PacketBuffer{
+		Parsed: &stack.ParsedPacket{
+			NetworkHeader:      ip,
+			TransportProtocol:  header.TCPProtocolNumber,
+			TransportHeader:    tcp,
+			TransportAvailable: true,
+		},
+	}
+}
+
+// TestBPFMatcherEquivalentToTCPMatcher checks that a hand-written cBPF
+// program matching "tcp dport 80" agrees with TCPMatcher configured for the
+// same port, across both a matching and a non-matching packet.
+func TestBPFMatcherEquivalentToTCPMatcher(t *testing.T) {
+	bm := newBPFMatcher(t, tcpDestPort80Program(t))
+	tm := newTCPMatcher(t, linux.XTTCP{
+		SourcePortEnd:        0xffff,
+		DestinationPortStart: 80,
+		DestinationPortEnd:   80,
+	})
+
+	for _, destPort := range []uint16{80, 443} {
+		pkt := bpfPacketWithTCPDestPort(destPort)
+		bpfMatched, bpfHotdrop := bm.Match(stack.Input, pkt, "eth0")
+		tcpMatched, tcpHotdrop := tm.Match(stack.Input, pkt, "eth0")
+		if bpfHotdrop || tcpHotdrop {
+			t.Fatalf("destPort=%d: hotdropped (bpf=%v, tcp=%v)", destPort, bpfHotdrop, tcpHotdrop)
+		}
+		if bpfMatched != tcpMatched {
+			t.Errorf("destPort=%d: BPFMatcher.Match() = %v, TCPMatcher.Match() = %v, want equal", destPort, bpfMatched, tcpMatched)
+		}
+	}
+}
+
+// payloadByteAtProgram returns a cBPF program that matches iff the byte at
+// absolute offset off equals want.
+func payloadByteAtProgram(t *testing.T, off uint32, want uint8) []linux.SockFilter {
+	t.Helper()
+	return assembleSockFilter(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Off: off, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(want), SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+}
+
+// TestBPFMatcherDoesNotDoubleCountHeaders is a regression test for a bug
+// where BPFMatcher reconstructed its view of the packet as
+// NetworkHeader+TransportHeader+Data without accounting for Data still
+// containing the very headers it was prepending, shifting every absolute
+// offset past them by their combined length. This builds a PacketBuffer
+// the way the real stack.Check/parsePacket path does post-fix: Data holds
+// only the payload, not the whole packet.
+func TestBPFMatcherDoesNotDoubleCountHeaders(t *testing.T) {
+	const payloadByte = 0xab
+	payload := []byte{payloadByte, 0, 0, 0}
+	off := uint32(header.IPv4MinimumSize + header.TCPMinimumSize)
+	bm := newBPFMatcher(t, payloadByteAtProgram(t, off, payloadByte))
+
+	pkt := stack.PacketBuffer{
+		Data: buffer.NewVectorisedView(len(payload), []buffer.View{buffer.View(payload)}),
+		Parsed: &stack.ParsedPacket{
+			NetworkHeader:      buildIPv4Header(uint8(header.TCPProtocolNumber)),
+			TransportProtocol:  header.TCPProtocolNumber,
+			TransportHeader:    buildTCPSegment(1234, 80, 0, nil),
+			TransportAvailable: true,
+		},
+	}
+
+	matched, hotdrop := bm.Match(stack.Input, pkt, "eth0")
+	if hotdrop {
+		t.Fatalf("hotdropped")
+	}
+	if !matched {
+		t.Errorf("BPFMatcher.Match() = false, want true: the payload byte at offset %d should be %#x, not a re-prepended header byte", off, payloadByte)
+	}
+}
+
+// TestBPFMatcherUnmarshalRejectsInvalidProgram feeds the loader a fixed set
+// of malformed cBPF programs, checking each is rejected at unmarshal time
+// rather than panicking or being accepted and failing later at Match time.
+func TestBPFMatcherUnmarshalRejectsInvalidProgram(t *testing.T) {
+	tests := []struct {
+		name string
+		prog []linux.SockFilter
+	}{
+		{
+			name: "jump target past end of program",
+			prog: []linux.SockFilter{
+				{Code: 0x15 /* BPF_JMP|BPF_JEQ|BPF_K */, JT: 10, JF: 0, K: 0},
+				{Code: 0x06 /* BPF_RET|BPF_K */, K: 0},
+			},
+		},
+		{
+			name: "empty program",
+			prog: nil,
+		},
+		{
+			name: "load with invalid addressing mode",
+			prog: []linux.SockFilter{
+				{Code: 0xff, K: 0},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			info := linux.XTBPFInfo{Mode: linux.XTBPFModeBytecode, BPFProgram: tc.prog}
+			buf := marshalXTBPFInfo(info)
+			if _, err := (bpfMarshaler{}).unmarshal(buf, stack.IPHeaderFilter{}); err == nil {
+				t.Errorf("unmarshal() succeeded for invalid program %v, want error", tc.prog)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netfilter
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/marshal/primitive"
+	"gvisor.dev/gvisor/pkg/sentry/socket/netlink"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+// Ad hoc message numbers for the ipt-over-netlink read path this file
+// exposes under NFNL_SUBSYS_IPSET. Legacy iptables has no netlink ABI on a
+// real kernel - xt_* rules are only readable via the IPT_SO_GET_INFO/
+// IPT_SO_GET_ENTRIES getsockopts and a separate revision-probe getsockopt -
+// so these message numbers don't correspond to anything in
+// include/uapi/linux/netfilter*.h; they exist purely so a netlink-speaking
+// caller in this sentry can ask the same three questions without a
+// setsockopt round trip.
+const (
+	iptMsgGetInfo uint8 = iota
+	iptMsgGetEntries
+	iptMsgGetRevision
+)
+
+// IPTablesReadProtocol implements netlink.Protocol for the ipt-over-netlink
+// read path described above: it answers the same three questions
+// IPT_SO_GET_INFO, IPT_SO_GET_ENTRIES, and the revision probe do - a
+// table's layout, its rules, and whether a given matcher revision is
+// supported - from an *stack.IPTables instead of a setsockopt.
+type IPTablesReadProtocol struct {
+	ipt *stack.IPTables
+}
+
+// NewIPTablesReadProtocol returns an IPTablesReadProtocol that reads from
+// ipt.
+func NewIPTablesReadProtocol(ipt *stack.IPTables) *IPTablesReadProtocol {
+	return &IPTablesReadProtocol{ipt: ipt}
+}
+
+// iptFamily extracts the NFNL_SUBSYS_* subsystem number from a netfilter
+// netlink message type, matching Linux's NFNL_SUBSYS_ID.
+func iptFamily(msgType uint16) uint8 {
+	return uint8(msgType >> 8)
+}
+
+// iptMsg extracts the message number, matching Linux's NFNL_MSG_TYPE.
+func iptMsg(msgType uint16) uint8 {
+	return uint8(msgType & 0xff)
+}
+
+// nameFromMessage reads a NUL-terminated table or matcher name out of a
+// request's raw payload; every request this protocol handles carries
+// nothing else.
+func nameFromMessage(data []byte) string {
+	for i, b := range data {
+		if b == 0 {
+			return string(data[:i])
+		}
+	}
+	return string(data)
+}
+
+// ProcessMessage implements netlink.Protocol.ProcessMessage.
+func (p *IPTablesReadProtocol) ProcessMessage(ctx netlink.MessageContext, msgHdr linux.NetlinkMessageHeader, data []byte, ms *netlink.MessageSet) error {
+	if iptFamily(msgHdr.Type) != linux.NFNL_SUBSYS_IPSET {
+		return fmt.Errorf("netfilter: unsupported subsystem %d", iptFamily(msgHdr.Type))
+	}
+
+	name := nameFromMessage(data)
+	switch iptMsg(msgHdr.Type) {
+	case iptMsgGetInfo:
+		return p.replyGetInfo(name, ms)
+	case iptMsgGetEntries:
+		return p.replyGetEntries(name, ms)
+	case iptMsgGetRevision:
+		return p.replyGetRevision(name, ms)
+	default:
+		return fmt.Errorf("netfilter: unsupported message type %d", iptMsg(msgHdr.Type))
+	}
+}
+
+func (p *IPTablesReadProtocol) replyGetInfo(tablename string, ms *netlink.MessageSet) error {
+	info, err := p.getInfo(tablename)
+	if err != nil {
+		return err
+	}
+	m := ms.AddMessage(linux.NetlinkMessageHeader{
+		Type: uint16(linux.NFNL_SUBSYS_IPSET)<<8 | uint16(iptMsgGetInfo),
+	})
+	m.Put(&info)
+	return nil
+}
+
+// getInfo answers the IPT_SO_GET_INFO-equivalent request: the table's
+// valid-hooks bitmap and, per hook, the rule index its built-in chain and
+// its underflow (default policy) rule start at.
+func (p *IPTablesReadProtocol) getInfo(tablename string) (linux.IPTGetinfo, error) {
+	table, ok := p.ipt.Table(tablename)
+	if !ok {
+		return linux.IPTGetinfo{}, fmt.Errorf("no such table %q", tablename)
+	}
+
+	var info linux.IPTGetinfo
+	copy(info.Name[:], tablename)
+	for hook := stack.Hook(0); hook < stack.NumHooks; hook++ {
+		if table.BuiltinChains[hook] == stack.HookUnset {
+			continue
+		}
+		info.ValidHooks |= 1 << uint(hook)
+		info.HookEntry[hook] = uint32(table.BuiltinChains[hook])
+		info.Underflow[hook] = uint32(table.Underflows[hook])
+	}
+	info.NumEntries = uint32(len(table.Rules))
+	info.Size = uint32(entriesSize(table))
+	return info, nil
+}
+
+func (p *IPTablesReadProtocol) replyGetEntries(tablename string, ms *netlink.MessageSet) error {
+	entries, err := p.getEntries(tablename)
+	if err != nil {
+		return err
+	}
+	m := ms.AddMessage(linux.NetlinkMessageHeader{
+		Type: uint16(linux.NFNL_SUBSYS_IPSET)<<8 | uint16(iptMsgGetEntries),
+	})
+	m.Put(primitive.ByteSlice(entries))
+	return nil
+}
+
+// getEntries answers the IPT_SO_GET_ENTRIES-equivalent request: every rule
+// in the table, each encoded as a real ipt_entry - the IPHeaderFilter
+// translated to an IPTIP, a zeroed XTCounters (gVisor doesn't maintain
+// per-rule packet/byte counters yet), and the rule's matchers marshaled
+// through the same matchMaker.marshal a plain iptables-save/-L would use,
+// so a caller diffing the two paths sees byte-identical matcher payloads.
+func (p *IPTablesReadProtocol) getEntries(tablename string) ([]byte, error) {
+	table, ok := p.ipt.Table(tablename)
+	if !ok {
+		return nil, fmt.Errorf("no such table %q", tablename)
+	}
+
+	var buf []byte
+	for _, rule := range table.Rules {
+		buf = append(buf, marshalRuleEntry(rule)...)
+	}
+	return buf, nil
+}
+
+func (p *IPTablesReadProtocol) replyGetRevision(name string, ms *netlink.MessageSet) error {
+	revision, ok := p.getRevision(name)
+	m := ms.AddMessage(linux.NetlinkMessageHeader{
+		Type: uint16(linux.NFNL_SUBSYS_IPSET)<<8 | uint16(iptMsgGetRevision),
+	})
+	m.Put(primitive.Uint8(revision))
+	var supported uint8
+	if ok {
+		supported = 1
+	}
+	m.Put(primitive.Uint8(supported))
+	return nil
+}
+
+// getRevision answers the revision-probe request that precedes a real
+// iptables-restore: whether name is a matcher this instance understands,
+// and at which xt_* revision. Every matcher registered through
+// registerMatchMaker in this package supports exactly revision 0.
+func (p *IPTablesReadProtocol) getRevision(name string) (revision uint8, ok bool) {
+	_, ok = matchMakers[name]
+	return 0, ok
+}
+
+// marshalRuleMatchers concatenates the wire-format encoding of every
+// matcher on rule, in order, via the matchMaker registered for each
+// matcher's name.
+func marshalRuleMatchers(rule stack.Rule) []byte {
+	var buf []byte
+	for _, m := range rule.Matchers {
+		mm, ok := matchMakers[m.Name()]
+		if !ok {
+			continue
+		}
+		buf = append(buf, mm.marshal(m)...)
+	}
+	return buf
+}
+
+// filterToIPTIP translates an IPHeaderFilter into the wire-format
+// linux.IPTIP an ipt_entry's "ip" member carries.
+func filterToIPTIP(filter stack.IPHeaderFilter) linux.IPTIP {
+	var ip linux.IPTIP
+	copy(ip.Dst[:], filter.Dst)
+	copy(ip.DstMask[:], filter.DstMask)
+	copy(ip.Src[:], filter.Src)
+	copy(ip.SrcMask[:], filter.SrcMask)
+	copy(ip.OutputInterface[:], filter.OutputInterface)
+	copy(ip.OutputInterfaceMask[:], filter.OutputInterfaceMask)
+	if filter.CheckProtocol {
+		ip.Protocol = uint16(filter.Protocol)
+	}
+	if filter.DstInvert {
+		ip.InverseFlags |= linux.IPT_INV_DSTIP
+	}
+	if filter.SrcInvert {
+		ip.InverseFlags |= linux.IPT_INV_SRCIP
+	}
+	if filter.OutputInterfaceInvert {
+		ip.InverseFlags |= linux.IPT_INV_VIA_OUT
+	}
+	return ip
+}
+
+// marshalRuleEntry encodes rule as a real ipt_entry: header, counters,
+// matchers, and target-offset bookkeeping, matching the layout
+// IPT_SO_GET_ENTRIES returns on a real kernel. The target's own content
+// isn't encoded yet - rule.Target has no introspection hook to ask what
+// kind of target it is or what verdict it carries outside of invoking it
+// against a packet - so next_offset reserves space for a standard target
+// sized entry and readers should treat every rule as implicitly ending in
+// one.
+func marshalRuleEntry(rule stack.Rule) []byte {
+	matchers := marshalRuleMatchers(rule)
+	targetSize := int(linux.SizeOfXTStandardTarget)
+
+	entry := linux.IPTEntry{
+		IP:           filterToIPTIP(rule.Filter),
+		TargetOffset: uint16(linux.SizeOfIPTEntry + len(matchers)),
+		NextOffset:   uint16(linux.SizeOfIPTEntry + len(matchers) + targetSize),
+	}
+	buf := make([]byte, 0, int(entry.NextOffset))
+	buf = binary.Marshal(buf, usermem.ByteOrder, entry)
+	buf = append(buf, matchers...)
+	buf = append(buf, make([]byte, targetSize)...)
+	return buf
+}
+
+func entriesSize(table stack.IPTable) int {
+	size := 0
+	for _, rule := range table.Rules {
+		size += len(marshalRuleEntry(rule))
+	}
+	return size
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netfilter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+// matcherEqual compares the matcher fields a matchMaker actually round
+// trips, ignoring derived state like BPFMatcher.vm that isn't part of the
+// wire format and won't compare equal across independently-built VMs.
+func matcherEqual(a, b stack.Matcher) bool {
+	switch av := a.(type) {
+	case *TCPMatcher:
+		bv, ok := b.(*TCPMatcher)
+		return ok && *av == *bv
+	case *BPFMatcher:
+		bv, ok := b.(*BPFMatcher)
+		return ok && reflect.DeepEqual(av.program, bv.program)
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// xtEntryMatchHeaderSize is the size of struct xt_entry_match's user-visible
+// header (match_size __u16, name char[29], revision __u8) that
+// marshalEntryMatch prepends before a matcher's own payload. The same
+// marshal/unmarshal pair backs both the setsockopt IPT_SO_GET_ENTRIES path
+// and the netlink GetEntries path added alongside it, so stripping this
+// header is all that's needed to feed one path's output back into the
+// other's matchMaker.unmarshal.
+const xtEntryMatchHeaderSize = 2 + 29 + 1
+
+// stripEntryMatchHeader undoes marshalEntryMatch, checking that the
+// embedded name matches wantName.
+func stripEntryMatchHeader(t *testing.T, buf []byte, wantName string) []byte {
+	t.Helper()
+	if len(buf) < xtEntryMatchHeaderSize {
+		t.Fatalf("marshaled matcher too short for xt_entry_match header: %d bytes", len(buf))
+	}
+	if got := strings.TrimRight(string(buf[2:2+29]), "\x00"); got != wantName {
+		t.Fatalf("xt_entry_match name = %q, want %q", got, wantName)
+	}
+	return buf[xtEntryMatchHeaderSize:]
+}
+
+// TestMatchMakerMarshalUnmarshalSymmetry round-trips every registered
+// matchMaker's marshal output back through its own unmarshal in isolation,
+// independent of any particular caller. TestGetEntriesRoundTrip below is
+// the test that actually drives ipt_netlink.go's read path end to end.
+//
+// Only the matchMakers actually registered in this tree (tcp, bpf) are
+// covered; no udp or icmp matcher exists here to extend this to.
+func TestMatchMakerMarshalUnmarshalSymmetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher stack.Matcher
+		filter  stack.IPHeaderFilter
+	}{
+		{
+			name: matcherNameTCP,
+			matcher: &TCPMatcher{
+				sourcePortStart:      1,
+				sourcePortEnd:        1024,
+				destinationPortStart: 80,
+				destinationPortEnd:   80,
+				flagMask:             header.TCPFlagSyn,
+				flagCompare:          header.TCPFlagSyn,
+				inverseFlags:         linux.XT_TCP_INV_SRCPT,
+			},
+			filter: stack.IPHeaderFilter{Protocol: header.TCPProtocolNumber},
+		},
+		{
+			name:    matcherNameBPF,
+			matcher: newBPFMatcher(t, tcpDestPort80Program(t)),
+			filter:  stack.IPHeaderFilter{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mm, ok := matchMakers[tc.name]
+			if !ok {
+				t.Fatalf("no matchMaker registered for %q", tc.name)
+			}
+
+			marshaled := mm.marshal(tc.matcher)
+			payload := stripEntryMatchHeader(t, marshaled, tc.name)
+
+			got, err := mm.unmarshal(payload, tc.filter)
+			if err != nil {
+				t.Fatalf("unmarshal() failed: %v", err)
+			}
+			if !matcherEqual(got, tc.matcher) {
+				t.Errorf("round trip changed matcher: got %+v, want %+v", got, tc.matcher)
+			}
+		})
+	}
+}
+
+// TestGetEntriesRoundTrip drives a rule through IPTablesReadProtocol's
+// actual getEntries/marshalRuleEntry read path - the production netlink
+// read path in ipt_netlink.go, not just the matchMaker it's built on - and decodes the
+// resulting ipt_entry back into an IPHeaderFilter and matcher, checking
+// both agree with the rule that was installed.
+//
+// This stops short of replyGetEntries's netlink message framing: the
+// netlink package isn't present in this tree to construct a MessageSet
+// against, so the netlink envelope itself is untested here; everything
+// replyGetEntries does other than wrap the message is covered.
+func TestGetEntriesRoundTrip(t *testing.T) {
+	tcpMatcher := &TCPMatcher{
+		sourcePortEnd:        0xffff,
+		destinationPortStart: 80,
+		destinationPortEnd:   80,
+	}
+	filter := stack.IPHeaderFilter{
+		Protocol:      header.TCPProtocolNumber,
+		CheckProtocol: true,
+		Src:           "\x0a\x00\x00\x01",
+		SrcMask:       "\xff\xff\xff\xff",
+	}
+	rule := stack.Rule{Filter: filter, Matchers: []stack.Matcher{tcpMatcher}}
+
+	ipt := stack.NewIPTables()
+	ipt.ReplaceTable("filter", stack.IPTable{Rules: []stack.Rule{rule}})
+
+	proto := NewIPTablesReadProtocol(ipt)
+	entries, err := proto.getEntries("filter")
+	if err != nil {
+		t.Fatalf("getEntries() failed: %v", err)
+	}
+
+	if len(entries) < int(linux.SizeOfIPTEntry) {
+		t.Fatalf("getEntries() returned %d bytes, too short for an ipt_entry", len(entries))
+	}
+	var entry linux.IPTEntry
+	if err := binary.Unmarshal(entries[:linux.SizeOfIPTEntry], usermem.ByteOrder, &entry); err != nil {
+		t.Fatalf("failed to unmarshal ipt_entry: %v", err)
+	}
+
+	wantIP := filterToIPTIP(filter)
+	if entry.IP != wantIP {
+		t.Errorf("ipt_entry.IP = %+v, want %+v", entry.IP, wantIP)
+	}
+
+	matcherPayload := entries[linux.SizeOfIPTEntry:entry.TargetOffset]
+	payload := stripEntryMatchHeader(t, matcherPayload, matcherNameTCP)
+	got, err := matchMakers[matcherNameTCP].unmarshal(payload, filter)
+	if err != nil {
+		t.Fatalf("unmarshal() of the round-tripped matcher failed: %v", err)
+	}
+	if !matcherEqual(got, tcpMatcher) {
+		t.Errorf("round trip through getEntries changed matcher: got %+v, want %+v", got, tcpMatcher)
+	}
+}
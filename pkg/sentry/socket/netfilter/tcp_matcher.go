@@ -46,6 +46,10 @@ func (tcpMarshaler) marshal(mr stack.Matcher) []byte {
 		SourcePortEnd:        matcher.sourcePortEnd,
 		DestinationPortStart: matcher.destinationPortStart,
 		DestinationPortEnd:   matcher.destinationPortEnd,
+		Option:               matcher.option,
+		FlagMask:             matcher.flagMask,
+		FlagCompare:          matcher.flagCompare,
+		InverseFlags:         matcher.inverseFlags,
 	}
 	buf := make([]byte, 0, linux.SizeOfXTTCP)
 	return marshalEntryMatch(matcherNameTCP, binary.Marshal(buf, usermem.ByteOrder, xttcp))
@@ -63,11 +67,8 @@ func (tcpMarshaler) unmarshal(buf []byte, filter stack.IPHeaderFilter) (stack.Ma
 	binary.Unmarshal(buf[:linux.SizeOfXTTCP], usermem.ByteOrder, &matchData)
 	nflog("parseMatchers: parsed XTTCP: %+v", matchData)
 
-	if matchData.Option != 0 ||
-		matchData.FlagMask != 0 ||
-		matchData.FlagCompare != 0 ||
-		matchData.InverseFlags != 0 {
-		return nil, fmt.Errorf("unsupported TCP matcher flags set")
+	if matchData.InverseFlags&^linux.XT_TCP_INV_MASK != 0 {
+		return nil, fmt.Errorf("unsupported TCP matcher inverse flags set: %#x", matchData.InverseFlags)
 	}
 
 	if filter.Protocol != header.TCPProtocolNumber {
@@ -79,6 +80,10 @@ func (tcpMarshaler) unmarshal(buf []byte, filter stack.IPHeaderFilter) (stack.Ma
 		sourcePortEnd:        matchData.SourcePortEnd,
 		destinationPortStart: matchData.DestinationPortStart,
 		destinationPortEnd:   matchData.DestinationPortEnd,
+		option:               matchData.Option,
+		flagMask:             matchData.FlagMask,
+		flagCompare:          matchData.FlagCompare,
+		inverseFlags:         matchData.InverseFlags,
 	}, nil
 }
 
@@ -88,6 +93,19 @@ type TCPMatcher struct {
 	sourcePortEnd        uint16
 	destinationPortStart uint16
 	destinationPortEnd   uint16
+
+	// option is the TCP option kind that must be present in the segment, or
+	// 0 if no option is required.
+	option uint8
+	// flagMask and flagCompare implement `--tcp-flags mask comp`: the flags
+	// named in flagMask are extracted from the segment and compared against
+	// flagCompare.
+	flagMask    uint8
+	flagCompare uint8
+	// inverseFlags is a bitmap of XT_TCP_INV_* bits negating the
+	// corresponding comparison: source port, destination port, flags, and
+	// option, in that order.
+	inverseFlags uint8
 }
 
 // Name implements Matcher.Name.
@@ -97,60 +115,85 @@ func (*TCPMatcher) Name() string {
 
 // Match implements Matcher.Match.
 func (tm *TCPMatcher) Match(hook stack.Hook, pkt stack.PacketBuffer, interfaceName string) (bool, bool) {
-	netHeader := header.IPv4(pkt.NetworkHeader)
-
-	if netHeader.TransportProtocol() != header.TCPProtocolNumber {
+	// stack.Check has already pulled up the network and transport headers
+	// into pkt.Parsed; we just read out of that cache.
+	parsed := pkt.Parsed
+	if parsed == nil {
 		return false, false
 	}
-
-	// We dont't match fragments.
-	if frag := netHeader.FragmentOffset(); frag != 0 {
-		if frag == 1 {
-			return false, true
-		}
+	if parsed.Malformed {
+		// There's no valid IP header here, so we hotdrop the packet.
+		return false, true
+	}
+	if parsed.TransportProtocol != header.TCPProtocolNumber {
 		return false, false
 	}
-
-	// Now we need the transport header. However, this may not have been set
-	// yet.
-	// TODO(gvisor.dev/issue/170): Parsing the transport header should
-	// ultimately be moved into the stack.Check codepath as matchers are
-	// added.
-	var tcpHeader header.TCP
-	if pkt.TransportHeader != nil {
-		tcpHeader = header.TCP(pkt.TransportHeader)
-	} else {
-		var length int
-		if hook == stack.Prerouting {
-			// The network header hasn't been parsed yet. We have to do it here.
-			hdr, ok := pkt.Data.PullUp(header.IPv4MinimumSize)
-			if !ok {
-				// There's no valid TCP header here, so we hotdrop the
-				// packet.
-				return false, true
-			}
-			h := header.IPv4(hdr)
-			pkt.NetworkHeader = hdr
-			length = int(h.HeaderLength())
-		}
-		// The TCP header hasn't been parsed yet. We have to do it here.
-		hdr, ok := pkt.Data.PullUp(length + header.TCPMinimumSize)
-		if !ok {
-			// There's no valid TCP header here, so we hotdrop the
-			// packet.
-			return false, true
-		}
-		tcpHeader = header.TCP(hdr[length:])
+	if !parsed.TransportAvailable {
+		// Either a fragment past the first, or the transport header
+		// couldn't be pulled up. Neither is a match.
+		return false, false
 	}
+	tcpHeader := header.TCP(parsed.TransportHeader)
 
 	// Check whether the source and destination ports are within the
-	// matching range.
-	if sourcePort := tcpHeader.SourcePort(); sourcePort < tm.sourcePortStart || tm.sourcePortEnd < sourcePort {
+	// matching range, honoring XT_TCP_INV_SRCPT/XT_TCP_INV_DSTPT.
+	sourcePort := tcpHeader.SourcePort()
+	inRange := sourcePort >= tm.sourcePortStart && sourcePort <= tm.sourcePortEnd
+	if inRange == (tm.inverseFlags&linux.XT_TCP_INV_SRCPT != 0) {
 		return false, false
 	}
-	if destinationPort := tcpHeader.DestinationPort(); destinationPort < tm.destinationPortStart || tm.destinationPortEnd < destinationPort {
+	destinationPort := tcpHeader.DestinationPort()
+	inRange = destinationPort >= tm.destinationPortStart && destinationPort <= tm.destinationPortEnd
+	if inRange == (tm.inverseFlags&linux.XT_TCP_INV_DSTPT != 0) {
 		return false, false
 	}
 
+	// Check the TCP flags, e.g. `--syn` is flagMask=FIN|SYN|RST|ACK,
+	// flagCompare=SYN.
+	if tm.flagMask != 0 {
+		flags := uint8(tcpHeader.Flags())
+		matched := flags&tm.flagMask == tm.flagCompare
+		if matched == (tm.inverseFlags&linux.XT_TCP_INV_FLAGS != 0) {
+			return false, false
+		}
+	}
+
+	// Check that the requested TCP option is present, e.g. `--tcp-option 2`
+	// for MSS.
+	if tm.option != 0 {
+		found := tcpOptionPresent(tcpHeader.Options(), tm.option)
+		if found == (tm.inverseFlags&linux.XT_TCP_INV_OPTION != 0) {
+			return false, false
+		}
+	}
+
 	return true, false
 }
+
+// tcpOptionPresent reports whether the TCP options buffer (as returned by
+// header.TCP.Options) contains an option of the given kind.
+func tcpOptionPresent(options []byte, kind uint8) bool {
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case header.TCPOptionKindEOL:
+			return false
+		case header.TCPOptionKindNOP:
+			i++
+			continue
+		}
+
+		if options[i] == kind {
+			return true
+		}
+
+		if i+1 >= len(options) {
+			return false
+		}
+		optLen := int(options[i+1])
+		if optLen < 2 {
+			return false
+		}
+		i += optLen
+	}
+	return false
+}
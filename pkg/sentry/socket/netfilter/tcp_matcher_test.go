@@ -0,0 +1,198 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netfilter
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/binary"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+// tcpOptionMSS is the wire kind number for the MSS option.
+const tcpOptionMSS = 2
+
+// buildTCPSegment returns a minimal TCP header (no payload) with the given
+// ports, flags, and options, padded to a 4-byte-aligned header length.
+func buildTCPSegment(srcPort, dstPort uint16, flags uint8, options []byte) []byte {
+	for len(options)%4 != 0 {
+		options = append(options, header.TCPOptionKindNOP)
+	}
+	hdr := make([]byte, header.TCPMinimumSize+len(options))
+	hdr[0], hdr[1] = byte(srcPort>>8), byte(srcPort)
+	hdr[2], hdr[3] = byte(dstPort>>8), byte(dstPort)
+	hdr[12] = byte((header.TCPMinimumSize + len(options)) / 4 << 4)
+	hdr[13] = flags
+	copy(hdr[header.TCPMinimumSize:], options)
+	return hdr
+}
+
+func newTCPMatcher(t *testing.T, matchData linux.XTTCP) *TCPMatcher {
+	t.Helper()
+	buf := make([]byte, 0, linux.SizeOfXTTCP)
+	buf = binary.Marshal(buf, usermem.ByteOrder, matchData)
+	m, err := (tcpMarshaler{}).unmarshal(buf, stack.IPHeaderFilter{Protocol: header.TCPProtocolNumber})
+	if err != nil {
+		t.Fatalf("unmarshal() failed: %v", err)
+	}
+	return m.(*TCPMatcher)
+}
+
+func packetWithTCP(tcp []byte) stack.PacketBuffer {
+	return stack.PacketBuffer{
+		Parsed: &stack.ParsedPacket{
+			TransportProtocol:  header.TCPProtocolNumber,
+			TransportHeader:    tcp,
+			TransportAvailable: true,
+		},
+	}
+}
+
+func TestTCPMatcherSyn(t *testing.T) {
+	tm := newTCPMatcher(t, linux.XTTCP{
+		DestinationPortEnd: 0xffff,
+		SourcePortEnd:      0xffff,
+		FlagMask:           header.TCPFlagFin | header.TCPFlagSyn | header.TCPFlagRst | header.TCPFlagAck,
+		FlagCompare:        header.TCPFlagSyn,
+	})
+
+	for _, tc := range []struct {
+		name  string
+		flags uint8
+		want  bool
+	}{
+		{name: "bare syn matches", flags: header.TCPFlagSyn, want: true},
+		{name: "syn-ack doesn't match", flags: header.TCPFlagSyn | header.TCPFlagAck, want: false},
+		{name: "ack alone doesn't match", flags: header.TCPFlagAck, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkt := packetWithTCP(buildTCPSegment(1234, 80, tc.flags, nil))
+			matched, hotdrop := tm.Match(stack.Input, pkt, "eth0")
+			if hotdrop {
+				t.Fatalf("Match() hotdropped")
+			}
+			if matched != tc.want {
+				t.Errorf("Match() = %v, want %v", matched, tc.want)
+			}
+		})
+	}
+}
+
+func TestTCPMatcherExplicitFlags(t *testing.T) {
+	// --tcp-flags SYN,ACK SYN,ACK
+	tm := newTCPMatcher(t, linux.XTTCP{
+		DestinationPortEnd: 0xffff,
+		SourcePortEnd:      0xffff,
+		FlagMask:           header.TCPFlagSyn | header.TCPFlagAck,
+		FlagCompare:        header.TCPFlagSyn | header.TCPFlagAck,
+	})
+
+	pkt := packetWithTCP(buildTCPSegment(1234, 80, header.TCPFlagSyn|header.TCPFlagAck, nil))
+	if matched, hotdrop := tm.Match(stack.Input, pkt, "eth0"); hotdrop || !matched {
+		t.Errorf("Match() = (%v, %v), want (true, false)", matched, hotdrop)
+	}
+
+	pkt = packetWithTCP(buildTCPSegment(1234, 80, header.TCPFlagSyn, nil))
+	if matched, hotdrop := tm.Match(stack.Input, pkt, "eth0"); hotdrop || matched {
+		t.Errorf("Match() = (%v, %v), want (false, false)", matched, hotdrop)
+	}
+}
+
+func TestTCPMatcherOption(t *testing.T) {
+	tm := newTCPMatcher(t, linux.XTTCP{
+		DestinationPortEnd: 0xffff,
+		SourcePortEnd:      0xffff,
+		Option:             tcpOptionMSS,
+	})
+
+	withOption := packetWithTCP(buildTCPSegment(1234, 80, 0, []byte{tcpOptionMSS, 4, 0x05, 0xb4}))
+	if matched, _ := tm.Match(stack.Input, withOption, "eth0"); !matched {
+		t.Errorf("Match() = false with MSS option present, want true")
+	}
+
+	withoutOption := packetWithTCP(buildTCPSegment(1234, 80, 0, nil))
+	if matched, _ := tm.Match(stack.Input, withoutOption, "eth0"); matched {
+		t.Errorf("Match() = true with no options, want false")
+	}
+}
+
+func TestTCPMatcherInverseVariants(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		matchData linux.XTTCP
+		pkt       stack.PacketBuffer
+		want      bool
+	}{
+		{
+			name: "inverse source port",
+			matchData: linux.XTTCP{
+				SourcePortStart:    1,
+				SourcePortEnd:      100,
+				DestinationPortEnd: 0xffff,
+				InverseFlags:       linux.XT_TCP_INV_SRCPT,
+			},
+			pkt:  packetWithTCP(buildTCPSegment(1234, 80, 0, nil)),
+			want: true, // 1234 is outside [1,100], and the check is inverted.
+		},
+		{
+			name: "inverse destination port",
+			matchData: linux.XTTCP{
+				SourcePortEnd:        0xffff,
+				DestinationPortStart: 1,
+				DestinationPortEnd:   100,
+				InverseFlags:         linux.XT_TCP_INV_DSTPT,
+			},
+			pkt:  packetWithTCP(buildTCPSegment(1234, 80, 0, nil)),
+			want: false, // 80 is inside [1,100], and the check is inverted.
+		},
+		{
+			name: "inverse flags",
+			matchData: linux.XTTCP{
+				SourcePortEnd:      0xffff,
+				DestinationPortEnd: 0xffff,
+				FlagMask:           header.TCPFlagSyn,
+				FlagCompare:        header.TCPFlagSyn,
+				InverseFlags:       linux.XT_TCP_INV_FLAGS,
+			},
+			pkt:  packetWithTCP(buildTCPSegment(1234, 80, header.TCPFlagSyn, nil)),
+			want: false, // SYN is present and matches flagCompare, but inverted.
+		},
+		{
+			name: "inverse option",
+			matchData: linux.XTTCP{
+				SourcePortEnd:      0xffff,
+				DestinationPortEnd: 0xffff,
+				Option:             tcpOptionMSS,
+				InverseFlags:       linux.XT_TCP_INV_OPTION,
+			},
+			pkt:  packetWithTCP(buildTCPSegment(1234, 80, 0, []byte{tcpOptionMSS, 4, 0x05, 0xb4})),
+			want: false, // the option is present, but the check is inverted.
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tm := newTCPMatcher(t, tc.matchData)
+			matched, hotdrop := tm.Match(stack.Input, tc.pkt, "eth0")
+			if hotdrop {
+				t.Fatalf("Match() hotdropped")
+			}
+			if matched != tc.want {
+				t.Errorf("Match() = %v, want %v", matched, tc.want)
+			}
+		})
+	}
+}
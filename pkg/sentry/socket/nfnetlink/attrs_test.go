@@ -0,0 +1,139 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfnetlink
+
+import (
+	"reflect"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/tcpip/stack/nftables"
+)
+
+// TestParseExprListMultiElement is a regression test for a bug where
+// parseExprList routed NFTA_RULE_EXPRESSIONS through the type-keyed
+// parseAttrs map: since every element of the list is an NFTA_LIST_ELEM
+// attribute, that coalesced all but the last expression away. A rule as
+// simple as "payload; cmp; verdict" lost its payload and cmp expressions.
+func TestParseExprListMultiElement(t *testing.T) {
+	want := []nftables.Expr{
+		&nftables.PayloadExpr{Base: nftables.PayloadBaseTransport, Offset: 2, Len: 2, Reg: 1},
+		&nftables.CmpExpr{Reg: 1, Op: nftables.CmpEq, Data: []byte{0, 22}},
+		&nftables.VerdictExpr{Verdict: nftables.VerdictAccept},
+	}
+
+	got, err := parseExprList(nil, nil, encodeExprList(want))
+	if err != nil {
+		t.Fatalf("parseExprList() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseExprList(encodeExprList(want)) = %#v, want %#v", got, want)
+	}
+}
+
+// TestParseSetElemKeysMultiElement is a regression test for the same
+// coalescing bug in parseSetElemKeys: a NEWSETELEM adding more than one
+// element to a set kept only the last key.
+func TestParseSetElemKeysMultiElement(t *testing.T) {
+	const keyLen = 4
+	want := [][]byte{
+		{10, 0, 0, 1},
+		{10, 0, 0, 2},
+		{10, 0, 0, 3},
+	}
+
+	var buf []byte
+	for _, key := range want {
+		elem := encodeAttr(linux.NFTA_SET_ELEM_KEY, key)
+		buf = append(buf, encodeAttr(linux.NFTA_LIST_ELEM, elem)...)
+	}
+
+	got, err := parseSetElemKeys(buf, keyLen)
+	if err != nil {
+		t.Fatalf("parseSetElemKeys() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSetElemKeys() = %#v, want %#v", got, want)
+	}
+}
+
+// TestParseExprRejectsInvalidCmpOp is a regression test for parseExpr
+// accepting any NFTA_CMP_OP value, unlike every other field it validates:
+// an out-of-range op used to fall through CmpExpr.Eval's switch at match
+// time (never matching) instead of being rejected here, at load time.
+func TestParseExprRejectsInvalidCmpOp(t *testing.T) {
+	attrs := map[uint16][]byte{
+		linux.NFTA_CMP_SREG: encodeAttrReg(linux.NFTA_CMP_SREG, 1)[4:],
+		linux.NFTA_CMP_OP:   encodeAttrUint32(linux.NFTA_CMP_OP, 99)[4:],
+		linux.NFTA_CMP_DATA: {0, 22},
+	}
+	if _, err := parseExpr(nil, nil, "cmp", attrs); err == nil {
+		t.Errorf("parseExpr(\"cmp\", ...) with an out-of-range op succeeded, want error")
+	}
+}
+
+// TestParseExprRejectsOversizedPayloadLen is a regression test for parseExpr
+// accepting any NFTA_PAYLOAD_LEN, unlike the register-bound data every other
+// case validates: an oversized length used to reach PayloadExpr.Eval, where
+// Regs.Store silently truncated the load to the register width at match
+// time, instead of being rejected here, at load time.
+func TestParseExprRejectsOversizedPayloadLen(t *testing.T) {
+	attrs := map[uint16][]byte{
+		linux.NFTA_PAYLOAD_BASE:   encodeAttrUint32(linux.NFTA_PAYLOAD_BASE, 1)[4:],
+		linux.NFTA_PAYLOAD_OFFSET: encodeAttrUint32(linux.NFTA_PAYLOAD_OFFSET, 0)[4:],
+		linux.NFTA_PAYLOAD_LEN:    encodeAttrUint32(linux.NFTA_PAYLOAD_LEN, nftables.RegisterWidth+1)[4:],
+		linux.NFTA_PAYLOAD_DREG:   encodeAttrReg(linux.NFTA_PAYLOAD_DREG, 1)[4:],
+	}
+	if _, err := parseExpr(nil, nil, "payload", attrs); err == nil {
+		t.Errorf("parseExpr(\"payload\", ...) with an oversized length succeeded, want error")
+	}
+}
+
+// TestParseExprLookupResolvesSet is a regression test for NEWSET/NEWSETELEM
+// populating a set that no expression could ever reference: parseExpr's
+// "lookup" case must resolve NFTA_LOOKUP_SET against the table a rule is
+// being installed into, and the resulting LookupExpr must match (or, with
+// NFT_LOOKUP_F_INV, not match) exactly the elements NEWSETELEM added.
+func TestParseExprLookupResolvesSet(t *testing.T) {
+	e := nftables.NewEngine()
+	table := e.Table(nftables.FamilyIP, "filter")
+	set := &nftables.Set{Name: "myset", KeyLen: 4, Elements: map[string]struct{}{
+		string([]byte{10, 0, 0, 1}): {},
+	}}
+	e.NewSet(table, set)
+
+	attrs := map[uint16][]byte{
+		linux.NFTA_LOOKUP_SREG: encodeAttrReg(linux.NFTA_LOOKUP_SREG, 1)[4:],
+		linux.NFTA_LOOKUP_SET:  encodeAttrString(linux.NFTA_LOOKUP_SET, "myset")[4:],
+	}
+	expr, err := parseExpr(e, table, "lookup", attrs)
+	if err != nil {
+		t.Fatalf("parseExpr(\"lookup\", ...) failed: %v", err)
+	}
+	lookup, ok := expr.(*nftables.LookupExpr)
+	if !ok {
+		t.Fatalf("parseExpr(\"lookup\", ...) = %T, want *nftables.LookupExpr", expr)
+	}
+	if lookup.Set != set {
+		t.Errorf("LookupExpr.Set = %p, want the table's %q set (%p)", lookup.Set, "myset", set)
+	}
+
+	if _, err := parseExpr(e, table, "lookup", map[uint16][]byte{
+		linux.NFTA_LOOKUP_SREG: encodeAttrReg(linux.NFTA_LOOKUP_SREG, 1)[4:],
+		linux.NFTA_LOOKUP_SET:  encodeAttrString(linux.NFTA_LOOKUP_SET, "nosuchset")[4:],
+	}); err == nil {
+		t.Errorf("parseExpr(\"lookup\", ...) referencing an unknown set succeeded, want error")
+	}
+}
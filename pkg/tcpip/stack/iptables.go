@@ -0,0 +1,276 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	// TablenameFilter is the name of the filter table.
+	TablenameFilter = "filter"
+
+	// TablenameNat is the name of the nat table.
+	TablenameNat = "nat"
+
+	// TablenameMangle is the name of the mangle table.
+	TablenameMangle = "mangle"
+)
+
+// HookUnset indicates that a table isn't registered for a given hook.
+const HookUnset = -1
+
+// NFHooker lets an alternate packet-processing engine (nftables) claim a
+// hook: when one is registered for a given Hook, IPTables.Check defers to
+// it instead of walking the legacy xt_* chains, so both engines produce
+// verdicts through the same code path.
+type NFHooker interface {
+	// Hooked reports whether the engine has a chain registered for hook.
+	Hooked(hook Hook) bool
+
+	// Check evaluates the engine's chains for hook against pkt and returns
+	// the resulting verdict.
+	Check(hook Hook, pkt PacketBuffer, interfaceName string) RuleVerdict
+}
+
+// NewIPTables returns a new IPTables with no tables registered.
+func NewIPTables() *IPTables {
+	return &IPTables{
+		tables: make(map[string]IPTable),
+	}
+}
+
+// SetNFTables installs the engine that IPTables.Check consults before
+// falling back to legacy chains for a given hook. Passing nil clears it.
+func (it *IPTables) SetNFTables(nf NFHooker) {
+	it.nftables = nf
+}
+
+// ParsedPacket holds the header offsets IPTables.Check computes once per
+// packet, before any matcher runs, so matchers don't each duplicate the
+// PullUp dance TCPMatcher used to do on every call.
+type ParsedPacket struct {
+	// NetworkHeader is the packet's parsed IPv4 header, or nil if it
+	// couldn't be pulled up.
+	NetworkHeader header.IPv4
+
+	// TransportProtocol is the protocol named in NetworkHeader. It's valid
+	// only when NetworkHeader is non-nil.
+	TransportProtocol tcpip.TransportProtocolNumber
+
+	// TransportHeader is the packet's transport header. It's valid only
+	// when TransportAvailable is true.
+	TransportHeader []byte
+
+	// TransportAvailable reports whether TransportHeader could be parsed:
+	// false for a fragment past the first, a header shorter than the
+	// transport protocol's minimum size, or an unrecognized protocol.
+	TransportAvailable bool
+
+	// Malformed reports that the packet was too short to contain a valid
+	// IPv4 header. TCPMatcher/BPFMatcher hotdrop on this, matching the
+	// legacy per-matcher PullUp they used to do before parsing moved here.
+	Malformed bool
+}
+
+// parsePacket pulls up pkt's network header (if hook is Prerouting and it
+// hasn't been parsed yet) and, protocol permitting, its transport header,
+// recording the result in pkt.NetworkHeader/TransportHeader as a side
+// effect so later stack code sees the same parse. Each header, once pulled
+// up, is also trimmed off the front of pkt.Data, matching the contract
+// PacketBuffer.Data documents: Data holds only what's left after whatever
+// headers have already been parsed out of it. Without that trim, a caller
+// reconstructing the on-wire packet as NetworkHeader+TransportHeader+Data
+// (e.g. BPFMatcher) would count those headers twice.
+//
+// Both headers are pulled up to their real length, not just their minimum
+// size: an IPv4 header carrying options is longer than IPv4MinimumSize, and
+// a TCP header carrying options is longer than TCPMinimumSize. Trimming (or
+// handing matchers) only the minimum-size prefix of such a header would
+// leave the options bytes in pkt.Data, where TCPMatcher/BPFMatcher would
+// misread them as payload.
+func parsePacket(hook Hook, pkt *PacketBuffer) ParsedPacket {
+	if pkt.NetworkHeader == nil {
+		if hook != Prerouting {
+			return ParsedPacket{}
+		}
+		hdr, ok := pkt.Data.PullUp(header.IPv4MinimumSize)
+		if !ok {
+			// Too short to be a valid IP header; this is what the legacy
+			// per-matcher PullUp used to hotdrop on.
+			return ParsedPacket{Malformed: true}
+		}
+		headerLen := int(header.IPv4(hdr).HeaderLength())
+		if headerLen < header.IPv4MinimumSize {
+			// The header claims to be shorter than even the fixed part we
+			// just read; that fixed part can't be trusted either.
+			return ParsedPacket{Malformed: true}
+		}
+		if headerLen > header.IPv4MinimumSize {
+			hdr, ok = pkt.Data.PullUp(headerLen)
+			if !ok {
+				// Options were declared but the packet was truncated
+				// before the end of the header; hotdrop rather than
+				// parsing a partial header as if it had none.
+				return ParsedPacket{Malformed: true}
+			}
+		}
+		pkt.NetworkHeader = hdr
+		pkt.Data.TrimFront(headerLen)
+	}
+	netHeader := header.IPv4(pkt.NetworkHeader)
+	parsed := ParsedPacket{
+		NetworkHeader:     netHeader,
+		TransportProtocol: netHeader.TransportProtocol(),
+	}
+
+	// We don't match the transport header of fragments past the first.
+	if netHeader.FragmentOffset() != 0 {
+		return parsed
+	}
+
+	if pkt.TransportHeader != nil {
+		parsed.TransportHeader = pkt.TransportHeader
+		parsed.TransportAvailable = true
+		return parsed
+	}
+
+	var minSize int
+	switch parsed.TransportProtocol {
+	case header.TCPProtocolNumber:
+		minSize = header.TCPMinimumSize
+	case header.UDPProtocolNumber:
+		minSize = header.UDPMinimumSize
+	case header.ICMPv4ProtocolNumber:
+		minSize = header.ICMPv4MinimumSize
+	default:
+		return parsed
+	}
+
+	// pkt.NetworkHeader, whether just pulled up above or already parsed by
+	// an earlier hook, has already been trimmed off pkt.Data, so the
+	// transport header starts right at its front.
+	hdr, ok := pkt.Data.PullUp(minSize)
+	if !ok {
+		return parsed
+	}
+
+	size := minSize
+	if parsed.TransportProtocol == header.TCPProtocolNumber {
+		size = int(header.TCP(hdr).DataOffset())
+		if size < header.TCPMinimumSize {
+			// A DataOffset that doesn't even cover the fixed part of the
+			// header we just read is malformed; leave TransportHeader
+			// unset rather than matching on garbage.
+			return parsed
+		}
+		if size > minSize {
+			hdr, ok = pkt.Data.PullUp(size)
+			if !ok {
+				return parsed
+			}
+		}
+	}
+
+	pkt.TransportHeader = hdr
+	pkt.Data.TrimFront(size)
+	parsed.TransportHeader = hdr
+	parsed.TransportAvailable = true
+	return parsed
+}
+
+// Check runs the packet through the appropriate chain for hook, trying the
+// nftables engine first (if one is registered for this hook) and falling
+// back to the legacy iptables chains otherwise. It returns true if the
+// packet should continue on its way and false if it should be dropped.
+func (it *IPTables) Check(hook Hook, pkt PacketBuffer, interfaceName string) bool {
+	parsed := parsePacket(hook, &pkt)
+	pkt.Parsed = &parsed
+
+	if it.nftables != nil && it.nftables.Hooked(hook) {
+		return it.nftables.Check(hook, pkt, interfaceName) != RuleDrop
+	}
+
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	for _, name := range it.priorities[hook] {
+		table := it.tables[name]
+		ruleIdx := table.BuiltinChains[hook]
+		if ruleIdx == HookUnset {
+			continue
+		}
+		switch verdict := it.checkChain(hook, pkt, table, ruleIdx, interfaceName); verdict {
+		case RuleAccept:
+			continue
+		case RuleDrop:
+			return false
+		default:
+			// RuleJump and RuleReturn shouldn't escape checkChain.
+			panic(verdict)
+		}
+	}
+	return true
+}
+
+// checkChain walks table's rules starting at ruleIdx, honoring jumps, until
+// it reaches a verdict that isn't a jump or return.
+func (it *IPTables) checkChain(hook Hook, pkt PacketBuffer, table IPTable, ruleIdx int, interfaceName string) RuleVerdict {
+	for ruleIdx < len(table.Rules) {
+		rule := table.Rules[ruleIdx]
+
+		if rule.Filter.CheckProtocol && pkt.Parsed != nil && rule.Filter.Protocol != pkt.Parsed.TransportProtocol {
+			ruleIdx++
+			continue
+		}
+
+		matched := true
+		hotdrop := false
+		for _, matcher := range rule.Matchers {
+			m, hd := matcher.Match(hook, pkt, interfaceName)
+			if hd {
+				hotdrop = true
+				break
+			}
+			if !m {
+				matched = false
+				break
+			}
+		}
+		if hotdrop {
+			return RuleDrop
+		}
+		if !matched {
+			ruleIdx++
+			continue
+		}
+
+		verdict, jumpTo := rule.Target.Action(pkt)
+		switch verdict {
+		case RuleJump:
+			if v := it.checkChain(hook, pkt, table, jumpTo, interfaceName); v != RuleReturn {
+				return v
+			}
+			ruleIdx++
+		case RuleReturn:
+			return RuleReturn
+		default:
+			return verdict
+		}
+	}
+	// Fell off the end of the chain: use the table's default policy for
+	// this hook.
+	return it.checkChain(hook, pkt, table, table.Underflows[hook], interfaceName)
+}
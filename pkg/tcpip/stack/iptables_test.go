@@ -0,0 +1,132 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"bytes"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+)
+
+// truncatedPacket returns a PacketBuffer whose Data is too short to hold a
+// valid IPv4 header.
+func truncatedPacket() PacketBuffer {
+	data := make([]byte, 10)
+	return PacketBuffer{Data: buffer.NewVectorisedView(len(data), []buffer.View{buffer.View(data)})}
+}
+
+// TestParsePacketMalformedNetworkHeader is a regression test for a bug
+// where a packet too short to hold a valid IPv4 header was treated as a
+// plain non-match instead of the hotdrop the legacy per-matcher PullUp used
+// to force, letting a malformed packet fall through to a chain's default
+// policy and potentially be accepted.
+func TestParsePacketMalformedNetworkHeader(t *testing.T) {
+	pkt := truncatedPacket()
+	parsed := parsePacket(Prerouting, &pkt)
+	if !parsed.Malformed {
+		t.Errorf("parsePacket(Prerouting, truncated) got Malformed = false, want true")
+	}
+	if parsed.NetworkHeader != nil {
+		t.Errorf("parsePacket(Prerouting, truncated) got NetworkHeader = %v, want nil", parsed.NetworkHeader)
+	}
+}
+
+// optionsPacket builds a PacketBuffer holding a real, on-wire IPv4 packet
+// whose IP header carries a 4-byte option (IHL 6, 24 bytes total) and whose
+// TCP header carries a 4-byte option of its own (data offset 6, 24 bytes
+// total), followed by payload. It drives parsePacket itself, rather than
+// hand-building a ParsedPacket, so a regression in header-length
+// computation shows up the way it would in production: as a misparse of
+// the real bytes.
+func optionsPacket(payload []byte) PacketBuffer {
+	const (
+		ipHeaderLen  = 24 // IHL 6: 5 fixed words + 1 word of options.
+		tcpHeaderLen = 24 // Data offset 6: 5 fixed words + 1 word of options.
+	)
+	ip := make([]byte, ipHeaderLen)
+	ip[0] = 0x46 // version 4, IHL 6
+	ip[9] = 6    // protocol TCP
+	tcp := make([]byte, tcpHeaderLen)
+	tcp[12] = 6 << 4 // data offset 6, no reserved/flag bits
+
+	data := append(append(ip, tcp...), payload...)
+	return PacketBuffer{Data: buffer.NewVectorisedView(len(data), []buffer.View{buffer.View(data)})}
+}
+
+// TestParsePacketOptions is a regression test for parsePacket trimming and
+// recording only the fixed-size prefix of the IPv4 and TCP headers instead
+// of their real, option-inclusive length: that left option bytes in
+// pkt.Data (double-counted by BPFMatcher) and handed TCPMatcher a
+// TransportHeader too short for TCP.Options() to read without a panic.
+func TestParsePacketOptions(t *testing.T) {
+	payload := []byte{1, 2, 3, 4}
+	pkt := optionsPacket(payload)
+	parsed := parsePacket(Prerouting, &pkt)
+
+	if parsed.Malformed {
+		t.Fatalf("parsePacket(Prerouting, optionsPacket) got Malformed = true, want false")
+	}
+	if got, want := len(parsed.NetworkHeader), 24; got != want {
+		t.Errorf("len(NetworkHeader) = %d, want %d", got, want)
+	}
+	if !parsed.TransportAvailable {
+		t.Fatalf("parsePacket(Prerouting, optionsPacket) got TransportAvailable = false, want true")
+	}
+	if got, want := len(parsed.TransportHeader), 24; got != want {
+		t.Errorf("len(TransportHeader) = %d, want %d", got, want)
+	}
+
+	gotPayload, ok := pkt.Data.PullUp(len(payload))
+	if !ok || !bytes.Equal(gotPayload, payload) {
+		t.Errorf("pkt.Data after parsePacket = %v, ok=%v, want %v", gotPayload, ok, payload)
+	}
+}
+
+// hotdropMatcher always hotdrops, standing in for TCPMatcher/BPFMatcher
+// reacting to ParsedPacket.Malformed without needing a real header parse.
+type hotdropMatcher struct{}
+
+func (hotdropMatcher) Name() string { return "hotdrop" }
+
+func (hotdropMatcher) Match(Hook, PacketBuffer, string) (bool, bool) {
+	return false, true
+}
+
+// acceptTarget always accepts, so a test relying on the default policy can
+// tell whether a hotdrop short-circuited past it.
+type acceptTarget struct{}
+
+func (acceptTarget) Action(PacketBuffer) (RuleVerdict, int) {
+	return RuleAccept, 0
+}
+
+// TestCheckChainHotdrop is a regression test for checkChain dropping a
+// packet the instant any matcher hotdrops, rather than letting it fall
+// through to the chain's default policy.
+func TestCheckChainHotdrop(t *testing.T) {
+	it := NewIPTables()
+	table := IPTable{
+		Rules: []Rule{
+			{Matchers: []Matcher{hotdropMatcher{}}, Target: acceptTarget{}},
+		},
+		BuiltinChains: [NumHooks]int{Prerouting: 0},
+		Underflows:    [NumHooks]int{Prerouting: 0},
+	}
+
+	if got := it.checkChain(Prerouting, PacketBuffer{}, table, 0, ""); got != RuleDrop {
+		t.Errorf("checkChain() with a hotdropping matcher = %v, want RuleDrop", got)
+	}
+}
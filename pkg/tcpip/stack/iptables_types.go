@@ -0,0 +1,177 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// Hook identifies one of the five hook points supported by both the
+// iptables and nftables engines.
+type Hook int
+
+// These correspond to values in include/uapi/linux/netfilter.h.
+const (
+	Prerouting Hook = iota
+	Input
+	Forward
+	Output
+	Postrouting
+	NumHooks
+)
+
+// A RuleVerdict is what a rule decides should be done with a packet.
+type RuleVerdict int
+
+const (
+	// RuleAccept indicates the packet should continue through netstack.
+	RuleAccept RuleVerdict = iota
+
+	// RuleDrop indicates the packet should be dropped.
+	RuleDrop
+
+	// RuleJump indicates the packet should jump to another chain.
+	RuleJump
+
+	// RuleReturn indicates the packet should return to the calling chain.
+	RuleReturn
+)
+
+// IPHeaderFilter holds basic IP filtering data common to every rule and
+// matcher: the protocol to match and the interface(s) involved.
+type IPHeaderFilter struct {
+	// Protocol matches the transport protocol.
+	Protocol tcpip.TransportProtocolNumber
+
+	// CheckProtocol determines whether Protocol should be checked during
+	// matching.
+	CheckProtocol bool
+
+	// Dst matches the destination IP address.
+	Dst tcpip.Address
+
+	// DstMask masks bits of the destination IP address when comparing with
+	// Dst.
+	DstMask tcpip.Address
+
+	// DstInvert inverts the meaning of the destination IP check, i.e. when
+	// true the filter will match packets that fail the destination check.
+	DstInvert bool
+
+	// Src matches the source IP address.
+	Src tcpip.Address
+
+	// SrcMask masks bits of the source IP address when comparing with Src.
+	SrcMask tcpip.Address
+
+	// SrcInvert inverts the meaning of the source IP check.
+	SrcInvert bool
+
+	// OutputInterface matches the name of the outgoing interface.
+	OutputInterface string
+
+	// OutputInterfaceMask masks the characters of the interface in
+	// OutputInterface.
+	OutputInterfaceMask string
+
+	// OutputInterfaceInvert inverts the meaning of interface matching.
+	OutputInterfaceInvert bool
+}
+
+// A Matcher is the interface for matching packets against a given rule.
+type Matcher interface {
+	// Name returns the name of the Matcher.
+	Name() string
+
+	// Match returns whether the packet matches and whether the packet
+	// should be hotdropped, i.e. dropped without eventually reaching a
+	// REJECT or ICMP response.
+	Match(hook Hook, packet PacketBuffer, interfaceName string) (matches bool, hotdrop bool)
+}
+
+// A Target is the interface for taking an action for a packet that has
+// matched a rule.
+type Target interface {
+	// Action takes an action on the packet and returns a verdict on how
+	// traversal should (or should not) continue. If the return value is
+	// Jump, it also returns the index of the chain to jump to.
+	Action(packet PacketBuffer) (RuleVerdict, int)
+}
+
+// A Rule is a packet processing rule: a hook that a matched packet is
+// compared to every Matcher; if all match, the Target is evaluated.
+type Rule struct {
+	// Filter holds basic IP filtering fields, common to every rule.
+	Filter IPHeaderFilter
+
+	// Target is the action to invoke if all the Matchers match the packet.
+	Target Target
+
+	// Matchers is the list of matchers for this rule.
+	Matchers []Matcher
+}
+
+// IPTable is one of the iptables tables, e.g. filter, nat, mangle.
+type IPTable struct {
+	// Rules holds the rules that make up the table.
+	Rules []Rule
+
+	// BuiltinChains maps a hook to a rule index; that index is the start
+	// of the built-in chain corresponding to the hook.
+	BuiltinChains [NumHooks]int
+
+	// Underflows maps a hook to a rule index; that index is used to
+	// verdict a packet that falls off the end of the built-in chain.
+	Underflows [NumHooks]int
+}
+
+// IPTables holds all the tables for a netstack.
+type IPTables struct {
+	// mu guards tables and priorities: IPT_SO_SET_REPLACE (ReplaceTable)
+	// can race with a packet arriving through Check on another goroutine,
+	// and a plain map is not safe for a concurrent read and write.
+	mu     sync.RWMutex
+	tables map[string]IPTable
+
+	// priorities maps each hook to a list of table names, ordered by
+	// priority, that have a chain registered for that hook.
+	priorities [NumHooks][]string
+
+	// nftables, if set, is consulted before the legacy tables above for any
+	// hook it has claimed. See NFHooker.
+	nftables NFHooker
+}
+
+// Table returns the named table and whether it exists, letting callers
+// outside this package (e.g. the netlink-based read path) introspect
+// installed rules without a setsockopt round trip.
+func (it *IPTables) Table(name string) (IPTable, bool) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	table, ok := it.tables[name]
+	return table, ok
+}
+
+// ReplaceTable installs table under name, replacing any table already
+// registered under that name. This is the counterpart IPT_SO_SET_REPLACE
+// (and tests exercising the read paths built on top of it) use to
+// populate IPTables.
+func (it *IPTables) ReplaceTable(name string, table IPTable) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.tables[name] = table
+}
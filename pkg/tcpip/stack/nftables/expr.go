@@ -0,0 +1,478 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nftables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// NumRegisters is the number of registers in a Regs bank. Each register
+// index names its own independent RegisterWidth-byte slot; indices are used
+// as given, with no translation between the 32-bit (NFT_REG32_*) and
+// 128-bit (NFT_REG_*) numbering schemes, so no two indices share storage.
+const NumRegisters = 16
+
+// ValidateReg reports an error if reg isn't a valid register index. Callers
+// that build an Expr from attacker-controlled input (netlink attributes)
+// must call this while parsing, rather than letting an out-of-range index
+// reach Regs.Load/Store and panic mid-match.
+func ValidateReg(reg int) error {
+	if reg < 0 || reg >= NumRegisters {
+		return fmt.Errorf("nftables: invalid register %d, want [0, %d)", reg, NumRegisters)
+	}
+	return nil
+}
+
+// RegisterWidth is the width in bytes of a single register slot. It bounds
+// how much data a cmp/bitwise expression can load out of or store into a
+// register.
+const RegisterWidth = 16
+
+// ValidateRegData reports an error if data is wider than a register.
+// Callers that build a CmpExpr/BitwiseExpr from attacker-controlled input
+// (netlink attributes) must call this while parsing, rather than letting
+// an oversized NFTA_CMP_DATA/NFTA_BITWISE_MASK/NFTA_BITWISE_XOR reach
+// Regs.Load and panic mid-match.
+func ValidateRegData(data []byte) error {
+	if len(data) > RegisterWidth {
+		return fmt.Errorf("nftables: register data too wide: %d bytes, want <= %d", len(data), RegisterWidth)
+	}
+	return nil
+}
+
+// Regs is the register bank expressions read from and write to while
+// evaluating a single rule.
+type Regs struct {
+	data [NumRegisters][16]byte
+}
+
+// Load returns the low n bytes of register reg.
+func (r *Regs) Load(reg, n int) []byte {
+	return r.data[reg][:n]
+}
+
+// Store writes data into register reg, left-aligned and zero-padded.
+func (r *Regs) Store(reg int, data []byte) {
+	r.data[reg] = [16]byte{}
+	copy(r.data[reg][:], data)
+}
+
+// EvalContext carries the packet and per-evaluation state (registers, and
+// the jump/goto target most recently selected by a verdict expression)
+// through a chain's rules.
+type EvalContext struct {
+	Packet        stack.PacketBuffer
+	InterfaceName string
+	Hook          stack.Hook
+
+	Regs Regs
+
+	// JumpTarget names the chain a VerdictExpr wants control transferred
+	// to when it evaluates to VerdictJump or VerdictGoto.
+	JumpTarget string
+}
+
+// Expr is one operation in an nftables rule: it either mutates ctx's
+// registers, matches/discards based on them, or (for the last expression in
+// a terminating rule) returns a verdict.
+type Expr interface {
+	// Eval performs the expression's operation and returns VerdictContinue
+	// unless the expression terminates the rule: a comparison that fails
+	// drops the rule silently by returning the internal verdictNoMatch,
+	// which the engine maps to "try the next rule"; a verdict expression
+	// (including an explicit nft "return") returns its verdict directly.
+	// verdictNoMatch is deliberately distinct from VerdictReturn so the
+	// engine can tell "this rule didn't match" apart from "this rule
+	// returned".
+	Eval(ctx *EvalContext) Verdict
+}
+
+// ImmediateExpr implements the "immediate" expression: load a constant into
+// a register.
+type ImmediateExpr struct {
+	Reg  int
+	Data []byte
+}
+
+// Eval implements Expr.Eval.
+func (e *ImmediateExpr) Eval(ctx *EvalContext) Verdict {
+	ctx.Regs.Store(e.Reg, e.Data)
+	return VerdictContinue
+}
+
+// PayloadBase identifies which header a PayloadExpr reads from, matching
+// NFT_PAYLOAD_*_HEADER.
+type PayloadBase int
+
+// Payload bases.
+const (
+	PayloadBaseLL PayloadBase = iota
+	PayloadBaseNetwork
+	PayloadBaseTransport
+)
+
+// PayloadExpr implements the "payload" expression: load Len bytes starting
+// at Offset within the named header into a register.
+type PayloadExpr struct {
+	Base   PayloadBase
+	Offset int
+	Len    int
+	Reg    int
+}
+
+// Eval implements Expr.Eval.
+func (e *PayloadExpr) Eval(ctx *EvalContext) Verdict {
+	var hdr []byte
+	switch e.Base {
+	case PayloadBaseNetwork:
+		hdr = []byte(ctx.Packet.NetworkHeader)
+	case PayloadBaseTransport:
+		hdr = []byte(ctx.Packet.TransportHeader)
+	default:
+		// Link-layer payload isn't available this far up the stack.
+		return verdictNoMatch
+	}
+	if e.Offset+e.Len > len(hdr) {
+		return verdictNoMatch
+	}
+	ctx.Regs.Store(e.Reg, hdr[e.Offset:e.Offset+e.Len])
+	return VerdictContinue
+}
+
+// CmpOp is a comparison operator, matching NFT_CMP_*.
+type CmpOp int
+
+// Comparison operators.
+const (
+	CmpEq CmpOp = iota
+	CmpNeq
+	CmpLt
+	CmpLte
+	CmpGt
+	CmpGte
+)
+
+// ValidateCmpOp reports an error if op isn't a recognized CmpOp value.
+// Callers that build a CmpExpr from attacker-controlled input (netlink
+// attributes) must call this while parsing, the same way ValidateReg
+// guards register indices, rather than letting an unrecognized
+// NFTA_CMP_OP silently fall through CmpExpr.Eval's switch and never
+// match instead of erroring at load time.
+func ValidateCmpOp(op CmpOp) error {
+	if op < CmpEq || op > CmpGte {
+		return fmt.Errorf("nftables: invalid cmp op %d", op)
+	}
+	return nil
+}
+
+// CmpExpr implements the "cmp" expression: compare a register against a
+// literal, dropping the rule (verdictNoMatch) on mismatch.
+type CmpExpr struct {
+	Reg  int
+	Op   CmpOp
+	Data []byte
+}
+
+// Eval implements Expr.Eval.
+func (e *CmpExpr) Eval(ctx *EvalContext) Verdict {
+	got := ctx.Regs.Load(e.Reg, len(e.Data))
+	cmp := bytes.Compare(got, e.Data)
+	var ok bool
+	switch e.Op {
+	case CmpEq:
+		ok = cmp == 0
+	case CmpNeq:
+		ok = cmp != 0
+	case CmpLt:
+		ok = cmp < 0
+	case CmpLte:
+		ok = cmp <= 0
+	case CmpGt:
+		ok = cmp > 0
+	case CmpGte:
+		ok = cmp >= 0
+	}
+	if !ok {
+		return verdictNoMatch
+	}
+	return VerdictContinue
+}
+
+// BitwiseExpr implements the "bitwise" expression: dst = (src & Mask) ^ Xor.
+type BitwiseExpr struct {
+	SrcReg, DstReg int
+	Mask, Xor      []byte
+}
+
+// Eval implements Expr.Eval.
+func (e *BitwiseExpr) Eval(ctx *EvalContext) Verdict {
+	src := ctx.Regs.Load(e.SrcReg, len(e.Mask))
+	out := make([]byte, len(e.Mask))
+	for i := range out {
+		out[i] = (src[i] & e.Mask[i]) ^ e.Xor[i]
+	}
+	ctx.Regs.Store(e.DstReg, out)
+	return VerdictContinue
+}
+
+// LookupExpr implements the "lookup" expression: test a register against a
+// named Set, dropping the rule (verdictNoMatch) on mismatch. This is how a
+// rule like "ip saddr @myset" is expressed, once a NEWSET/NEWSETELEM pair
+// has populated the Set it references.
+type LookupExpr struct {
+	SrcReg int
+	Set    *Set
+	// Invert matches Linux's NFT_LOOKUP_F_INV: report a match when the key
+	// is absent from Set instead of present.
+	Invert bool
+}
+
+// Eval implements Expr.Eval.
+func (e *LookupExpr) Eval(ctx *EvalContext) Verdict {
+	found := e.Set.Has(ctx.Regs.Load(e.SrcReg, e.Set.KeyLen))
+	if found == e.Invert {
+		return verdictNoMatch
+	}
+	return VerdictContinue
+}
+
+// MetaKey identifies a piece of packet metadata, matching NFT_META_*.
+type MetaKey int
+
+// Meta keys.
+const (
+	MetaKeyL4Proto MetaKey = iota
+	MetaKeyIIfname
+	MetaKeyOIfname
+)
+
+// MetaExpr implements the "meta" expression: load a metadata field (e.g.
+// the transport protocol number or interface name) into a register.
+type MetaExpr struct {
+	Key MetaKey
+	Reg int
+}
+
+// Eval implements Expr.Eval.
+func (e *MetaExpr) Eval(ctx *EvalContext) Verdict {
+	switch e.Key {
+	case MetaKeyL4Proto:
+		nh := ctx.Packet.NetworkHeader
+		if len(nh) == 0 {
+			return verdictNoMatch
+		}
+		var proto tcpip.TransportProtocolNumber
+		switch header.IPVersion(nh) {
+		case header.IPv4Version:
+			proto = header.IPv4(nh).TransportProtocol()
+		case header.IPv6Version:
+			proto = header.IPv6(nh).TransportProtocol()
+		default:
+			return verdictNoMatch
+		}
+		ctx.Regs.Store(e.Reg, []byte{byte(proto)})
+	case MetaKeyIIfname, MetaKeyOIfname:
+		ctx.Regs.Store(e.Reg, []byte(ctx.InterfaceName))
+	default:
+		return verdictNoMatch
+	}
+	return VerdictContinue
+}
+
+// CounterExpr implements the "counter" expression: tally packets and bytes
+// seen by this rule.
+type CounterExpr struct {
+	Packets, Bytes uint64
+}
+
+// Eval implements Expr.Eval.
+func (e *CounterExpr) Eval(ctx *EvalContext) Verdict {
+	e.Packets++
+	// ctx.Packet.Data holds only what's left after NetworkHeader and
+	// TransportHeader have been pulled off its front (see
+	// stack.parsePacket), so the on-wire packet size is the sum of all
+	// three, not just Data alone.
+	e.Bytes += uint64(len(ctx.Packet.NetworkHeader)) + uint64(len(ctx.Packet.TransportHeader)) + uint64(ctx.Packet.Data.Size())
+	return VerdictContinue
+}
+
+// LogExpr implements the "log" expression: emit an nflog-style trace line
+// and continue evaluating the rule.
+type LogExpr struct {
+	Prefix string
+}
+
+// Eval implements Expr.Eval.
+func (e *LogExpr) Eval(ctx *EvalContext) Verdict {
+	log.Debugf("nftables: %s hook=%v if=%s", e.Prefix, ctx.Hook, ctx.InterfaceName)
+	return VerdictContinue
+}
+
+// VerdictExpr implements the terminating "immediate" verdict expression:
+// accept, drop, queue, jump, goto, or return.
+type VerdictExpr struct {
+	Verdict Verdict
+	// Chain is the jump/goto target, valid only when Verdict is
+	// VerdictJump or VerdictGoto.
+	Chain string
+}
+
+// Eval implements Expr.Eval.
+func (e *VerdictExpr) Eval(ctx *EvalContext) Verdict {
+	if e.Verdict == VerdictJump || e.Verdict == VerdictGoto {
+		ctx.JumpTarget = e.Chain
+	}
+	return e.Verdict
+}
+
+// CtKey identifies a connection-tracking field, matching NFT_CT_*. Engine
+// doesn't maintain a connection-tracking table, so only the state is
+// exposed, and every packet is reported as NEW.
+type CtKey int
+
+// Ct keys.
+const (
+	CtKeyState CtKey = iota
+)
+
+// Connection-tracking state bits, matching NF_CT_STATE_*_BIT.
+const (
+	CtStateInvalid uint32 = 1 << iota
+	CtStateNew
+	CtStateEstablished
+	CtStateRelated
+)
+
+// CtExpr implements the "ct" expression: load a connection-tracking field
+// into a register. Without a connection-tracking table to consult, every
+// packet looks like the first one on its connection, so CtKeyState always
+// reports CtStateNew; that's enough for a rule like "ct state new accept"
+// gating a default-accept chain, but not enough to recognize established
+// or related traffic.
+type CtExpr struct {
+	Key CtKey
+	Reg int
+}
+
+// Eval implements Expr.Eval.
+func (e *CtExpr) Eval(ctx *EvalContext) Verdict {
+	switch e.Key {
+	case CtKeyState:
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], CtStateNew)
+		ctx.Regs.Store(e.Reg, buf[:])
+	default:
+		return verdictNoMatch
+	}
+	return VerdictContinue
+}
+
+// NatType distinguishes which address a NatExpr rewrites, matching
+// NFT_NAT_SNAT/NFT_NAT_DNAT.
+type NatType int
+
+// Nat types.
+const (
+	NatSNAT NatType = iota
+	NatDNAT
+)
+
+// NatExpr implements a minimal "nat" statement: rewrite the source or
+// destination address in place from RegAddr, for whichever of IPv4/IPv6 the
+// packet's network header turns out to be. Real nft also rewrites the
+// transport port and remembers the mapping per connection so replies get
+// NATed back to the original address; Engine has no connection-tracking
+// table to remember that mapping in, so this only performs the stateless,
+// per-packet address rewrite a single rule can express.
+type NatExpr struct {
+	Type NatType
+	// RegAddr holds the new address: header.IPv4AddressSize bytes for an
+	// IPv4 packet, header.IPv6AddressSize bytes for an IPv6 one.
+	RegAddr int
+}
+
+// Eval implements Expr.Eval.
+func (e *NatExpr) Eval(ctx *EvalContext) Verdict {
+	nh := ctx.Packet.NetworkHeader
+	if len(nh) == 0 {
+		return verdictNoMatch
+	}
+	switch header.IPVersion(nh) {
+	case header.IPv4Version:
+		ip := header.IPv4(nh)
+		addr := tcpip.Address(ctx.Regs.Load(e.RegAddr, header.IPv4AddressSize))
+		if e.Type == NatSNAT {
+			ip.SetSourceAddress(addr)
+		} else {
+			ip.SetDestinationAddress(addr)
+		}
+	case header.IPv6Version:
+		ip := header.IPv6(nh)
+		addr := tcpip.Address(ctx.Regs.Load(e.RegAddr, header.IPv6AddressSize))
+		if e.Type == NatSNAT {
+			ip.SetSourceAddress(addr)
+		} else {
+			ip.SetDestinationAddress(addr)
+		}
+	default:
+		return verdictNoMatch
+	}
+	return VerdictContinue
+}
+
+// RejectType distinguishes the response a "reject" statement asks for,
+// matching NFT_REJECT_*.
+type RejectType int
+
+// Reject types.
+const (
+	RejectICMPUnreachable RejectType = iota
+	RejectTCPReset
+)
+
+// RejectExpr implements the terminating "reject" expression. Engine has no
+// path to originate a packet of its own (the ICMP unreachable or TCP RST
+// reply nft would send), so for now it drops the packet exactly like an
+// explicit "drop" - the common case for a migrated iptables REJECT rule is
+// that the reply was never relied upon, just the fact that the packet
+// doesn't get through.
+type RejectExpr struct {
+	Type RejectType
+}
+
+// Eval implements Expr.Eval.
+func (e *RejectExpr) Eval(ctx *EvalContext) Verdict {
+	return VerdictDrop
+}
+
+// QueueExpr implements the terminating "queue" expression (NFQUEUE):
+// hand the packet to a userspace queue. Engine doesn't implement userspace
+// queueing, so Eval reports VerdictQueue and Engine.Check treats that like
+// an accept, so that an unconfigured queue doesn't wedge the stack.
+type QueueExpr struct {
+	Num uint16
+}
+
+// Eval implements Expr.Eval.
+func (e *QueueExpr) Eval(ctx *EvalContext) Verdict {
+	return VerdictQueue
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nftables
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// acceptSSH returns a rule matching "tcp dport 22 accept": load the
+// destination port via payload, compare it, and only then emit a verdict.
+func acceptSSH() Rule {
+	return Rule{Exprs: []Expr{
+		&PayloadExpr{Base: PayloadBaseTransport, Offset: 2, Len: 2, Reg: 1},
+		&CmpExpr{Reg: 1, Op: CmpEq, Data: []byte{0, 22}},
+		&VerdictExpr{Verdict: VerdictAccept},
+	}}
+}
+
+func dropAll() Rule {
+	return Rule{Exprs: []Expr{&VerdictExpr{Verdict: VerdictDrop}}}
+}
+
+// tcpPacket builds a minimal PacketBuffer whose transport header is just
+// enough of a TCP header for PayloadExpr to read the destination port.
+func tcpPacket(destPort uint16) stack.PacketBuffer {
+	hdr := make([]byte, 4)
+	hdr[2] = byte(destPort >> 8)
+	hdr[3] = byte(destPort)
+	return stack.PacketBuffer{
+		TransportHeader: hdr,
+		Parsed: &stack.ParsedPacket{
+			TransportHeader:    hdr,
+			TransportAvailable: true,
+		},
+	}
+}
+
+// TestEvaluateChainMultiRule is a regression test for a bug where a failed
+// match (e.g. the cmp in acceptSSH not matching) was conflated with an
+// explicit "return" and aborted the whole chain instead of advancing to the
+// next rule, making every rule after the first one in a chain unreachable.
+func TestEvaluateChainMultiRule(t *testing.T) {
+	e := NewEngine()
+	chain := &Chain{
+		Name:   "input",
+		Base:   true,
+		Hook:   stack.Input,
+		Policy: ChainPolicy(VerdictAccept),
+		Rules:  []Rule{acceptSSH(), dropAll()},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		destPort uint16
+		want     Verdict
+	}{
+		{name: "matches first rule", destPort: 22, want: VerdictAccept},
+		{name: "falls through to second rule", destPort: 80, want: VerdictDrop},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &EvalContext{Packet: tcpPacket(tc.destPort), Hook: stack.Input}
+			if got := e.evaluateChain(chain, ctx); got != tc.want {
+				t.Errorf("evaluateChain() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestEvaluateChainExplicitReturn checks that an explicit "return" from a
+// base chain applies the chain's policy instead of silently accepting.
+func TestEvaluateChainExplicitReturn(t *testing.T) {
+	e := NewEngine()
+	chain := &Chain{
+		Name:   "input",
+		Base:   true,
+		Hook:   stack.Input,
+		Policy: ChainPolicy(VerdictDrop),
+		Rules: []Rule{
+			{Exprs: []Expr{&VerdictExpr{Verdict: VerdictReturn}}},
+		},
+	}
+	ctx := &EvalContext{Packet: tcpPacket(80), Hook: stack.Input}
+	if got, want := e.evaluateChain(chain, ctx), VerdictDrop; got != want {
+		t.Errorf("evaluateChain() = %v, want %v", got, want)
+	}
+}
+
+// TestEvaluateChainGotoFallthrough checks that a "goto" to a chain that
+// falls through without a terminating verdict applies the calling base
+// chain's policy, rather than silently accepting.
+func TestEvaluateChainGotoFallthrough(t *testing.T) {
+	e := NewEngine()
+	table := e.Table(FamilyIP, "filter")
+	empty := &Chain{Name: "empty"}
+	table.Chains["empty"] = empty
+	input := &Chain{
+		Name:   "input",
+		Base:   true,
+		Hook:   stack.Input,
+		Policy: ChainPolicy(VerdictDrop),
+		Rules: []Rule{
+			{Exprs: []Expr{&VerdictExpr{Verdict: VerdictGoto, Chain: "empty"}}},
+		},
+	}
+	table.Chains["input"] = input
+
+	ctx := &EvalContext{Packet: tcpPacket(80), Hook: stack.Input}
+	if got, want := e.evaluateChain(input, ctx), VerdictDrop; got != want {
+		t.Errorf("evaluateChain() = %v, want %v", got, want)
+	}
+}
+
+// TestLookupExprEval checks LookupExpr.Eval against a populated Set,
+// including the NFT_LOOKUP_F_INV-equivalent Invert flag.
+func TestLookupExprEval(t *testing.T) {
+	set := &Set{Name: "myset", KeyLen: 4, Elements: map[string]struct{}{
+		string([]byte{10, 0, 0, 1}): {},
+	}}
+	var regs Regs
+	regs.Store(1, []byte{10, 0, 0, 1})
+	ctx := &EvalContext{Regs: regs}
+
+	for _, tc := range []struct {
+		name   string
+		lookup LookupExpr
+		want   Verdict
+	}{
+		{name: "present", lookup: LookupExpr{SrcReg: 1, Set: set}, want: VerdictContinue},
+		{name: "present, inverted", lookup: LookupExpr{SrcReg: 1, Set: set, Invert: true}, want: verdictNoMatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.lookup.Eval(ctx); got != tc.want {
+				t.Errorf("Eval() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	var absentRegs Regs
+	absentRegs.Store(1, []byte{10, 0, 0, 2})
+	absentCtx := &EvalContext{Regs: absentRegs}
+	if got, want := (&LookupExpr{SrcReg: 1, Set: set}).Eval(absentCtx), verdictNoMatch; got != want {
+		t.Errorf("Eval() for an absent key = %v, want %v", got, want)
+	}
+	if got, want := (&LookupExpr{SrcReg: 1, Set: set, Invert: true}).Eval(absentCtx), VerdictContinue; got != want {
+		t.Errorf("Eval() for an absent key, inverted, = %v, want %v", got, want)
+	}
+}
+
+// ipv4Packet builds a minimal PacketBuffer whose network header is a bare
+// IPv4 header (just enough for packetFamily to classify it).
+func ipv4Packet() stack.PacketBuffer {
+	hdr := make([]byte, 20)
+	hdr[0] = 0x45 // version 4, 20-byte header
+	return stack.PacketBuffer{NetworkHeader: hdr}
+}
+
+// ipv6Packet builds a minimal PacketBuffer whose network header is a bare
+// IPv6 header.
+func ipv6Packet() stack.PacketBuffer {
+	hdr := make([]byte, 40)
+	hdr[0] = 0x60 // version 6
+	return stack.PacketBuffer{NetworkHeader: hdr}
+}
+
+// TestCheckFiltersByFamily is a regression test for a bug where
+// baseChainsForHook ran every base chain on a hook regardless of the
+// table's Family, so an ip6 table's rules fired on IPv4 traffic (and vice
+// versa) instead of being scoped to their declared family.
+func TestCheckFiltersByFamily(t *testing.T) {
+	e := NewEngine()
+	ip6Table := e.Table(FamilyIP6, "filter")
+	ip6Table.Chains["input"] = &Chain{
+		Name:   "input",
+		Base:   true,
+		Hook:   stack.Input,
+		Policy: ChainPolicy(VerdictAccept),
+		Rules:  []Rule{dropAll()},
+	}
+
+	if got, want := e.Check(stack.Input, ipv4Packet(), "eth0"), stack.RuleAccept; got != want {
+		t.Errorf("Check() for IPv4 packet against an ip6-only table = %v, want %v", got, want)
+	}
+	if got, want := e.Check(stack.Input, ipv6Packet(), "eth0"), stack.RuleDrop; got != want {
+		t.Errorf("Check() for IPv6 packet against an ip6-only table = %v, want %v", got, want)
+	}
+}
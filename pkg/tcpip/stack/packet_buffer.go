@@ -0,0 +1,45 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stack
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+)
+
+// PacketBuffer contains all the data of a network packet as it moves
+// through the stack, plus the metadata netfilter and the routing code need
+// to make decisions about it.
+//
+// PacketBuffer is intentionally passed by value: code that records a
+// newly-parsed header into it (e.g. parsePacket) takes a *PacketBuffer and
+// updates that copy in place, and callers keep using the updated copy.
+type PacketBuffer struct {
+	// Data holds the packet's payload, starting after whatever headers have
+	// already been pulled off of it into NetworkHeader/TransportHeader.
+	Data buffer.VectorisedView
+
+	// NetworkHeader holds the packet's network-layer header, once it has
+	// been parsed out of Data.
+	NetworkHeader buffer.View
+
+	// TransportHeader holds the packet's transport-layer header, once it
+	// has been parsed out of Data.
+	TransportHeader buffer.View
+
+	// Parsed holds the header offsets IPTables.Check computed once for
+	// this packet, so matchers don't each re-run PullUp. It is nil outside
+	// of the netfilter Check codepath.
+	Parsed *ParsedPacket
+}